@@ -0,0 +1,262 @@
+// Package amqp implements broker.Broker on top of RabbitMQ via
+// streadway/amqp. It is the transport dispatcher has always used; this
+// package just gives that existing behavior a name other transports (see
+// broker/redis) can be swapped in for.
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/gofort/dispatcher/broker"
+)
+
+// Broker is a broker.Broker backed by an AMQP connection.
+type Broker struct {
+	con *amqp.Connection
+
+	publishMu sync.Mutex // serializes Publish so a confirm off confirms always belongs to the publish waiting on it
+	publishCh *amqp.Channel
+	confirms  chan amqp.Confirmation
+
+	consumeMu       sync.Mutex // guards consumeChannels against concurrent Consume/Close calls
+	consumeChannels []*amqp.Channel
+}
+
+// NewBroker wraps con, an already-established AMQP connection, as a
+// broker.Broker. Dialing and reconnecting con remains the caller's
+// responsibility, exactly as it was before this package existed.
+func NewBroker(con *amqp.Connection) (*Broker, error) {
+
+	ch, err := con.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating publish channel: %v", err)
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("Error enabling publisher confirms: %v", err)
+	}
+
+	return &Broker{
+		con:       con,
+		publishCh: ch,
+		confirms:  ch.NotifyPublish(make(chan amqp.Confirmation, 8)),
+	}, nil
+
+}
+
+// DeclareQueue declares queue as a durable queue, along with its companion
+// delay queue (see delayQueueName), using a short-lived channel of its own so
+// it never races with the dedicated publish/consume channels.
+//
+// The delay queue is what makes Message.Expiration on Publish actually delay
+// delivery: a per-message TTL only expires a message sitting unconsumed in a
+// queue, it does not postpone delivery to an actively-consuming worker, so a
+// delayed message is parked on this otherwise-unconsumed queue until it
+// expires and its dead-letter-exchange/routing-key bounce it back onto queue
+// (the same trick the legacy direct-AMQP path uses, see declareDelayQueue in
+// the main module).
+func (b *Broker) DeclareQueue(queue string) error {
+
+	ch, err := b.con.Channel()
+	if err != nil {
+		return fmt.Errorf("Error creating channel to declare queue %s: %v", queue, err)
+	}
+	defer ch.Close()
+
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("Error declaring queue %s: %v", queue, err)
+	}
+
+	_, err = ch.QueueDeclare(
+		delayQueueName(queue),
+		true,  // durable
+		false, // auto-delete
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("Error declaring delay queue for %s: %v", queue, err)
+	}
+
+	return nil
+
+}
+
+// delayQueueName returns the name of the delay queue Publish parks delayed
+// messages for queue on until they expire back onto it.
+func delayQueueName(queue string) string {
+	return queue + ".retry"
+}
+
+// Consume opens a dedicated channel for queue, bounds it to limit
+// unacknowledged deliveries via Qos, and translates its deliveries into
+// broker.Delivery values until the channel's deliveries close (on Close, or
+// if the underlying AMQP channel/connection drops).
+func (b *Broker) Consume(queue, tag string, limit int) (<-chan broker.Delivery, error) {
+
+	ch, err := b.con.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating channel to consume queue %s: %v", queue, err)
+	}
+
+	if err := ch.Qos(limit, 0, false); err != nil {
+		return nil, fmt.Errorf("Error setting QoS for queue %s: %v", queue, err)
+	}
+
+	deliveries, err := ch.Consume(queue, tag, false, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error consuming queue %s: %v", queue, err)
+	}
+
+	b.consumeMu.Lock()
+	b.consumeChannels = append(b.consumeChannels, ch)
+	b.consumeMu.Unlock()
+
+	out := make(chan broker.Delivery)
+
+	go func() {
+		defer close(out)
+		for d := range deliveries {
+			out <- broker.Delivery{
+				Queue:      queue,
+				Body:       d.Body,
+				Headers:    d.Headers,
+				RetryCount: broker.RetryCountFromHeaders(d.Headers),
+				Handle:     d,
+			}
+		}
+	}()
+
+	return out, nil
+
+}
+
+// Publish sends msg to exchange/key and waits for the broker's publisher
+// confirm before returning, so callers can tell a publish lost to a dropped
+// connection apart from one the broker actually accepted. Publish calls are
+// serialized, since confirms arrive on b.confirms in the same order messages
+// were published on b.publishCh and nothing else ties a confirm back to the
+// publish it's for.
+//
+// A non-zero msg.Expiration is not published straight to exchange/key: a
+// per-message TTL only expires a message that's sitting unconsumed in a
+// queue, it does nothing to delay delivery to a worker already consuming
+// that queue. Instead the message goes to key's delay queue (see
+// DeclareQueue/delayQueueName), which nothing consumes, and waits there until
+// its TTL elapses and its dead-letter-exchange bounces it back onto key for
+// real delivery. This only works when exchange is "" and key names a queue
+// directly (true of every retry publish in this codebase); a
+// non-default exchange has no single queue to derive a delay queue name
+// from, so Expiration is ignored for those.
+func (b *Broker) Publish(exchange, key string, msg broker.Message) error {
+
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	publishing := amqp.Publishing{
+		Headers:      headers,
+		Body:         msg.Body,
+		DeliveryMode: amqp.Persistent,
+	}
+
+	routingKey := key
+
+	if msg.Expiration > 0 {
+		publishing.Expiration = fmt.Sprintf("%d", msg.Expiration.Milliseconds())
+		if exchange == "" {
+			routingKey = delayQueueName(key)
+		}
+	}
+
+	if err := b.publishCh.Publish(exchange, routingKey, false, false, publishing); err != nil {
+		return err
+	}
+
+	select {
+	case confirm, ok := <-b.confirms:
+		if !ok || !confirm.Ack {
+			return errors.New("broker did not confirm the publish")
+		}
+	case <-time.After(5 * time.Second):
+		return errors.New("timed out waiting for the broker's publish confirm")
+	}
+
+	return nil
+
+}
+
+// Ack acknowledges d, which must have come from this Broker's Consume.
+func (b *Broker) Ack(d broker.Delivery) error {
+
+	ad, ok := d.Handle.(amqp.Delivery)
+	if !ok {
+		return errors.New("Delivery was not produced by this broker")
+	}
+
+	return ad.Ack(false)
+
+}
+
+// Nack rejects d, which must have come from this Broker's Consume.
+func (b *Broker) Nack(d broker.Delivery, requeue bool) error {
+
+	ad, ok := d.Handle.(amqp.Delivery)
+	if !ok {
+		return errors.New("Delivery was not produced by this broker")
+	}
+
+	return ad.Nack(false, requeue)
+
+}
+
+// Bind binds queue to exchange under key, using a short-lived channel of its
+// own so it never races with the dedicated publish/consume channels.
+func (b *Broker) Bind(exchange, queue, key string) error {
+
+	ch, err := b.con.Channel()
+	if err != nil {
+		return fmt.Errorf("Error creating channel to bind queue %s: %v", queue, err)
+	}
+	defer ch.Close()
+
+	if err := ch.QueueBind(queue, key, exchange, false, nil); err != nil {
+		return fmt.Errorf("Error binding queue %s to exchange %s: %v", queue, exchange, err)
+	}
+
+	return nil
+
+}
+
+// Close closes the dedicated publish channel along with every channel opened
+// by Consume.
+func (b *Broker) Close() error {
+
+	err := b.publishCh.Close()
+
+	b.consumeMu.Lock()
+	defer b.consumeMu.Unlock()
+
+	for _, ch := range b.consumeChannels {
+		if cerr := ch.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	b.consumeChannels = nil
+
+	return err
+
+}
@@ -0,0 +1,108 @@
+// Package broker defines the transport abstraction dispatcher workers can
+// talk to. Task code never touches a Broker directly: a worker built with
+// WorkerConfig.Broker set consumes from it and publishes its retries and
+// dead-letters through it, so that worker can be pointed at RabbitMQ, Redis,
+// or any other backend that implements this interface without its task code
+// changing. The server's own publisher does not use a Broker; it always
+// publishes over the server's AMQP connection.
+package broker
+
+import "time"
+
+// Delivery is a single message handed out by a Broker's Consume channel,
+// along with enough information to Ack, Nack or read retry bookkeeping off
+// of it.
+type Delivery struct {
+	Queue      string
+	Body       []byte
+	Headers    map[string]interface{}
+	RetryCount int
+
+	// Handle is opaque, implementation-specific state a Broker stashes on a
+	// Delivery it hands out so its own Ack/Nack can find whatever native
+	// handle (an amqp.Delivery, a Redis processing-list entry, ...) it needs
+	// to acknowledge or requeue it. Callers outside the Broker that produced
+	// a Delivery should never read or set it.
+	Handle interface{}
+}
+
+// Message is what gets published to a Broker, either as a fresh task or as a
+// republished retry/dead-letter copy.
+type Message struct {
+	Headers map[string]interface{}
+
+	Body []byte
+
+	// Expiration is how long the message should wait before becoming visible
+	// to consumers; zero means deliver it immediately. Used for retry delay;
+	// dead-letter publishes leave it zero.
+	Expiration time.Duration
+}
+
+// Broker is the transport a Worker built with WorkerConfig.Broker runs against.
+// Implementations live in their own subpackage (broker/amqp, broker/redis)
+// so picking one never pulls the other's client library into a build.
+type Broker interface {
+	// DeclareQueue creates queue if it doesn't already exist. Idempotent.
+	// Delayed delivery (retries) is handled entirely through
+	// Message.Expiration on Publish, so callers don't declare a second queue
+	// for it; an implementation that needs one (broker/amqp's delay queue)
+	// declares it here along with queue.
+	DeclareQueue(queue string) error
+
+	// Consume starts delivering messages published to queue. tag identifies
+	// this consumer (a worker name) and limit, on transports that support it,
+	// bounds how many unacknowledged deliveries the broker will hand out at
+	// once before waiting for Acks (broker/redis ignores it).
+	Consume(queue, tag string, limit int) (<-chan Delivery, error)
+
+	// Publish sends msg to queue. exchange and key are interpreted however
+	// the transport needs to: RabbitMQ uses them as an exchange and routing
+	// key, a Redis implementation can ignore exchange and treat key as the
+	// queue name.
+	Publish(exchange, key string, msg Message) error
+
+	// Ack confirms a delivery was handled successfully and need not be
+	// redelivered.
+	Ack(d Delivery) error
+
+	// Nack reports a delivery failed. If requeue is true the broker makes it
+	// available again immediately; otherwise it is dropped, on the
+	// assumption the caller has already republished it itself (to a delay
+	// queue or dead letter destination) if it wants it to survive.
+	Nack(d Delivery, requeue bool) error
+
+	// Bind associates queue with exchange under routing key key, so a message
+	// published to exchange/key is routed onto queue. Transports with no notion
+	// of exchanges (e.g. Redis) can make this a no-op: Publish's key already
+	// names the queue directly for them.
+	Bind(exchange, queue, key string) error
+
+	// Close releases every resource this Broker holds (connections, background
+	// goroutines, etc).
+	Close() error
+}
+
+// RetryCountFromHeaders reads how many times a delivery has already been
+// retried off of headers, using the same x-retry-count convention every
+// Broker implementation (and dispatcher's own retry bookkeeping) shares.
+func RetryCountFromHeaders(headers map[string]interface{}) int {
+
+	if headers == nil {
+		return 0
+	}
+
+	switch v := headers["x-retry-count"].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+
+}
@@ -0,0 +1,29 @@
+package broker
+
+import "testing"
+
+func TestRetryCountFromHeaders(t *testing.T) {
+
+	cases := []struct {
+		name    string
+		headers map[string]interface{}
+		want    int
+	}{
+		{"nil headers", nil, 0},
+		{"missing key", map[string]interface{}{"other": "x"}, 0},
+		{"int32", map[string]interface{}{"x-retry-count": int32(3)}, 3},
+		{"int64", map[string]interface{}{"x-retry-count": int64(4)}, 4},
+		{"int", map[string]interface{}{"x-retry-count": 5}, 5},
+		{"float64", map[string]interface{}{"x-retry-count": float64(6)}, 6},
+		{"unexpected type", map[string]interface{}{"x-retry-count": "7"}, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := RetryCountFromHeaders(c.headers); got != c.want {
+				t.Errorf("RetryCountFromHeaders(%v) = %d, want %d", c.headers, got, c.want)
+			}
+		})
+	}
+
+}
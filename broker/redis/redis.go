@@ -0,0 +1,295 @@
+// Package redis implements broker.Broker on top of Redis, modeled on the
+// common topic-based Redis worker pattern: BRPOPLPUSH moves a message from a
+// queue's list straight onto a per-consumer processing list so a crash
+// between receiving and Acking never loses it, and a visibility-timeout ZSET
+// drives redelivery of anything that sits in a processing list too long
+// without being Acked.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/gofort/dispatcher/broker"
+)
+
+// Broker is a broker.Broker backed by Redis lists and sorted sets.
+type Broker struct {
+	client *redis.Client
+
+	visibilityTimeout time.Duration
+	reclaimInterval   time.Duration
+
+	queues sync.Map // queue name -> struct{}, populated by DeclareQueue/Consume
+
+	stop chan struct{}
+}
+
+// envelope is what actually gets stored in Redis for a message; it carries
+// enough of broker.Delivery's shape that a consumer can rebuild one without
+// dispatcher needing to know which Broker it's talking to. Nonce makes every
+// envelope's JSON encoding unique even when two messages have byte-identical
+// headers/body/retry count, since the visibility and delay ZSETs key their
+// entries by that encoding and need distinct members per in-flight message.
+type envelope struct {
+	Headers    map[string]interface{} `json:"headers"`
+	Body       []byte                 `json:"body"`
+	RetryCount int                    `json:"retry_count"`
+	Nonce      int64                  `json:"nonce"`
+}
+
+// handle is the broker.Delivery.Handle value this package hands out, letting
+// Ack/Nack find the raw entry they need to remove from Redis.
+type handle struct {
+	queue         string
+	processingKey string
+	raw           string
+}
+
+// NewBroker wraps client as a broker.Broker and starts its background
+// reclaim loop, which requeues anything whose visibility timeout has
+// expired (its consumer is presumed dead) or whose retry delay has elapsed.
+// visibilityTimeout is how long a delivery may sit in a processing list
+// before it is considered abandoned; zero uses a 30 second default.
+func NewBroker(client *redis.Client, visibilityTimeout time.Duration) *Broker {
+
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = 30 * time.Second
+	}
+
+	b := &Broker{
+		client:            client,
+		visibilityTimeout: visibilityTimeout,
+		reclaimInterval:   time.Second,
+		stop:              make(chan struct{}),
+	}
+
+	go b.reclaimLoop()
+
+	return b
+
+}
+
+// DeclareQueue records queue as one the reclaim loop should watch. Redis
+// needs no schema up front - the list and sorted sets backing a queue are
+// created implicitly the first time something is pushed to them - so this
+// never talks to Redis itself.
+func (b *Broker) DeclareQueue(queue string) error {
+	b.queues.Store(queue, struct{}{})
+	return nil
+}
+
+// Consume starts a goroutine that repeatedly moves one message at a time
+// from queue's list onto tag's processing list via BRPOPLPUSH, records it in
+// the visibility ZSET, and forwards it as a broker.Delivery. limit is
+// currently unused: unlike AMQP's Qos, Redis has no broker-side notion of
+// "stop handing out deliveries until earlier ones are Acked", so bounding
+// concurrency is left to the caller (dispatcher's Worker already does this
+// via its semaphore).
+func (b *Broker) Consume(queue, tag string, limit int) (<-chan broker.Delivery, error) {
+
+	b.queues.Store(queue, struct{}{})
+
+	processingKey := b.processingKey(queue, tag)
+
+	out := make(chan broker.Delivery)
+
+	go func() {
+		defer close(out)
+
+		ctx := context.Background()
+
+		for {
+			select {
+			case <-b.stop:
+				return
+			default:
+			}
+
+			raw, err := b.client.BRPopLPush(ctx, b.queueKey(queue), processingKey, time.Second).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				time.Sleep(b.reclaimInterval)
+				continue
+			}
+
+			var env envelope
+			if err := json.Unmarshal([]byte(raw), &env); err != nil {
+				// Corrupt entry; drop it rather than redeliver it forever.
+				b.client.LRem(ctx, processingKey, 1, raw)
+				continue
+			}
+
+			b.client.ZAdd(ctx, b.visibilityKey(queue), &redis.Z{
+				Score:  float64(time.Now().Add(b.visibilityTimeout).Unix()),
+				Member: raw,
+			})
+
+			out <- broker.Delivery{
+				Queue:      queue,
+				Body:       env.Body,
+				Headers:    env.Headers,
+				RetryCount: env.RetryCount,
+				Handle:     handle{queue: queue, processingKey: processingKey, raw: raw},
+			}
+
+		}
+
+	}()
+
+	return out, nil
+
+}
+
+// Publish pushes msg onto the queue named by key. exchange is ignored -
+// Redis has no equivalent concept. A non-zero msg.Expiration holds the
+// message in a delay ZSET instead of the queue's list, where the reclaim
+// loop picks it up once it's due, which is how scheduleRetryBroker's retry
+// delay is implemented against this transport.
+func (b *Broker) Publish(exchange, key string, msg broker.Message) error {
+
+	env := envelope{
+		Headers:    msg.Headers,
+		Body:       msg.Body,
+		RetryCount: broker.RetryCountFromHeaders(msg.Headers),
+		Nonce:      rand.Int63(),
+	}
+
+	raw, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("Error marshaling message for queue %s: %v", key, err)
+	}
+
+	ctx := context.Background()
+
+	if msg.Expiration > 0 {
+		return b.client.ZAdd(ctx, b.delayKey(key), &redis.Z{
+			Score:  float64(time.Now().Add(msg.Expiration).Unix()),
+			Member: raw,
+		}).Err()
+	}
+
+	return b.client.LPush(ctx, b.queueKey(key), raw).Err()
+
+}
+
+// Ack removes d from its processing list and the visibility ZSET, which
+// together is all that's needed to stop it from ever being redelivered.
+func (b *Broker) Ack(d broker.Delivery) error {
+
+	h, ok := d.Handle.(handle)
+	if !ok {
+		return errors.New("Delivery was not produced by this broker")
+	}
+
+	ctx := context.Background()
+	b.client.LRem(ctx, h.processingKey, 1, h.raw)
+	b.client.ZRem(ctx, b.visibilityKey(h.queue), h.raw)
+
+	return nil
+
+}
+
+// Nack removes d from its processing list and the visibility ZSET, then, if
+// requeue is true, pushes it straight back onto its queue.
+func (b *Broker) Nack(d broker.Delivery, requeue bool) error {
+
+	h, ok := d.Handle.(handle)
+	if !ok {
+		return errors.New("Delivery was not produced by this broker")
+	}
+
+	ctx := context.Background()
+	b.client.LRem(ctx, h.processingKey, 1, h.raw)
+	b.client.ZRem(ctx, b.visibilityKey(h.queue), h.raw)
+
+	if requeue {
+		return b.client.LPush(ctx, b.queueKey(h.queue), h.raw).Err()
+	}
+
+	return nil
+
+}
+
+// Bind is a no-op: Redis has no concept of exchanges or bindings, and
+// Publish's key already names the destination queue directly.
+func (b *Broker) Bind(exchange, queue, key string) error {
+	return nil
+}
+
+// Close stops the reclaim loop and closes the Redis client.
+func (b *Broker) Close() error {
+	close(b.stop)
+	return b.client.Close()
+}
+
+// reclaimLoop periodically requeues messages whose visibility timeout has
+// expired (their consumer is presumed dead) and messages whose retry delay
+// has elapsed, until Close stops it.
+func (b *Broker) reclaimLoop() {
+
+	ticker := time.NewTicker(b.reclaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.reclaimDue(func(queue string) string { return b.visibilityKey(queue) })
+			b.reclaimDue(func(queue string) string { return b.delayKey(queue) })
+		}
+	}
+
+}
+
+// reclaimDue moves every member of each known queue's ZSET (named by
+// zsetKey) whose score has passed back onto that queue's list. The ZREM
+// guards against two Brokers racing to reclaim the same entry: only whichever
+// one actually removes it gets to requeue it.
+func (b *Broker) reclaimDue(zsetKey func(queue string) string) {
+
+	ctx := context.Background()
+	now := fmt.Sprintf("%d", time.Now().Unix())
+
+	b.queues.Range(func(k, _ interface{}) bool {
+
+		queue := k.(string)
+		key := zsetKey(queue)
+
+		due, err := b.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			return true
+		}
+
+		for _, raw := range due {
+			removed, err := b.client.ZRem(ctx, key, raw).Result()
+			if err != nil || removed == 0 {
+				continue
+			}
+			b.client.LPush(ctx, b.queueKey(queue), raw)
+		}
+
+		return true
+
+	})
+
+}
+
+// Key helpers. Every key for a given queue shares a {queue} hash tag so a
+// Redis Cluster deployment keeps them in the same slot.
+func (b *Broker) queueKey(queue string) string      { return "dispatcher:{" + queue + "}:queue" }
+func (b *Broker) visibilityKey(queue string) string { return "dispatcher:{" + queue + "}:visibility" }
+func (b *Broker) delayKey(queue string) string      { return "dispatcher:{" + queue + "}:delay" }
+func (b *Broker) processingKey(queue, tag string) string {
+	return "dispatcher:{" + queue + "}:processing:" + tag
+}
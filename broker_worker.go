@@ -0,0 +1,326 @@
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/gofort/dispatcher/broker"
+)
+
+// This file is the consume/publish path used by a worker built with
+// WorkerConfig.Broker set - i.e. running against broker/redis or any other
+// broker.Broker instead of the legacy direct-AMQP fields in worker.go. It
+// mirrors that path's shape (same dispatch/retry/dead-letter behavior) but
+// talks to w.transport throughout instead of w.ch/w.consumeChannels, so it has
+// no Server.SuperviseReconnects equivalent: non-AMQP transports are expected
+// to recover on their own (broker/redis, for one, already does via its
+// visibility-timeout reclaim loop).
+
+// initBroker starts consuming every queue this worker owns from w.transport.
+func (w *Worker) initBroker(ctx context.Context) error {
+
+	w.working = true
+
+	w.stopConsume = make(chan struct{})
+	w.consumingStopped = make(chan struct{})
+	w.sem = make(chan struct{}, w.limit)
+
+	deliveries := make(map[string]<-chan broker.Delivery, len(w.queues))
+
+	for queue := range w.queues {
+
+		d, err := w.transport.Consume(queue, w.name, w.limit)
+		if err != nil {
+			return err
+		}
+
+		deliveries[queue] = d
+
+	}
+
+	go w.consumeBroker(ctx, deliveries)
+
+	return nil
+
+}
+
+func (w *Worker) consumeBroker(ctx context.Context, deliveries map[string]<-chan broker.Delivery) {
+
+	w.log.Infof("Worker %s started consuming", w.name)
+
+	for {
+
+		queue, d, ok, stopped := w.nextBrokerDelivery(deliveries)
+
+		if stopped {
+			w.log.Debug("Consuming stopped")
+			w.consumingStopped <- struct{}{}
+			return
+		}
+
+		if !ok {
+			continue
+		}
+
+		if len(d.Body) == 0 {
+			w.log.Error("Empty task received")
+			w.transport.Nack(d, false)
+			continue
+		}
+
+		var task Task
+		if err := json.Unmarshal(d.Body, &task); err != nil {
+			w.transport.Nack(d, false)
+			w.log.Errorf("%v, task body: %s", errors.New("Can't unmarshal received task"), string(d.Body))
+			continue
+		}
+
+		taskConfig, ok := w.tasks[task.Name]
+		if !ok {
+			w.transport.Nack(d, true)
+			w.log.Errorf("Received task (%s-%s) which is not registered in this worker, task was requeued, but somebody should take it from this queue in other case error will be retried", task.Name, task.UUID)
+			continue
+		}
+
+		w.sem <- struct{}{}
+		w.tasksInProgress.Add(1)
+
+		go w.consumeOneBroker(ctx, queue, d, task, taskConfig)
+
+	}
+
+}
+
+// nextBrokerDelivery mirrors nextDelivery, but over broker.Delivery channels.
+func (w *Worker) nextBrokerDelivery(deliveries map[string]<-chan broker.Delivery) (queue string, d broker.Delivery, ok bool, stopped bool) {
+
+	if w.strictPriority {
+		return w.nextBrokerDeliveryStrict(deliveries)
+	}
+
+	return w.nextBrokerDeliveryWeighted(deliveries)
+
+}
+
+func (w *Worker) nextBrokerDeliveryStrict(deliveries map[string]<-chan broker.Delivery) (string, broker.Delivery, bool, bool) {
+
+	for _, queue := range w.priorityOrder() {
+
+		select {
+		case <-w.stopConsume:
+			return "", broker.Delivery{}, false, true
+		case d, ok := <-deliveries[queue]:
+			if !ok {
+				continue
+			}
+			return queue, d, true, false
+		case <-time.After(dispatchPollInterval):
+		}
+
+	}
+
+	return "", broker.Delivery{}, false, false
+
+}
+
+func (w *Worker) nextBrokerDeliveryWeighted(deliveries map[string]<-chan broker.Delivery) (string, broker.Delivery, bool, bool) {
+
+	order := w.weightedOrder()
+
+	cases := make([]reflect.SelectCase, 0, len(order)+2)
+	queueForCase := make([]string, 0, len(order)+2)
+
+	for _, queue := range order {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(deliveries[queue])})
+		queueForCase = append(queueForCase, queue)
+	}
+
+	stopIndex := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.stopConsume)})
+
+	timeoutIndex := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(dispatchPollInterval))})
+
+	chosen, value, ok := reflect.Select(cases)
+
+	switch {
+	case chosen == stopIndex:
+		return "", broker.Delivery{}, false, true
+	case chosen == timeoutIndex || !ok:
+		return "", broker.Delivery{}, false, false
+	default:
+		return queueForCase[chosen], value.Interface().(broker.Delivery), true, false
+	}
+
+}
+
+func (w *Worker) consumeOneBroker(ctx context.Context, queue string, d broker.Delivery, task Task, taskConfig TaskConfig) {
+	defer w.tasksInProgress.Done()
+	defer func() { <-w.sem }()
+
+	var err error
+
+	w.log.Infof("Handling task %s", task.UUID)
+
+	w.metrics.TaskReceived(w.name, queue)
+	w.metrics.InFlightDelta(w.name, queue, 1)
+	defer w.metrics.InFlightDelta(w.name, queue, -1)
+
+	startedAt := time.Now()
+
+	reflectedTaskFunction := reflect.ValueOf(taskConfig.Function)
+
+	if taskConfig.TaskUUIDAsFirstArg {
+		taskUUID := []TaskArgument{{"string", task.UUID}}
+		task.Args = append(taskUUID, task.Args...)
+	}
+
+	reflectedTaskArgs, err := reflectArgs(task.Args)
+	if err != nil {
+		w.transport.Nack(d, false)
+		w.log.Errorf("Can't reflect task (%s) arguments: %v", task.UUID, err)
+		return
+	}
+
+	var taskCtx context.Context
+	var cancel context.CancelFunc
+
+	if taskConfig.TimeoutSeconds > 0 {
+		taskCtx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(taskConfig.TimeoutSeconds))
+	} else {
+		taskCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	inFlight := &inFlightTask{cancel: cancel, requeue: func() { w.transport.Nack(d, true) }}
+	w.inFlight.Store(task.UUID, inFlight)
+	defer w.inFlight.Delete(task.UUID)
+
+	if taskConfig.ContextAsFirstArg {
+		reflectedTaskArgs = append([]reflect.Value{reflect.ValueOf(taskCtx)}, reflectedTaskArgs...)
+	}
+
+	attempt := d.RetryCount
+
+	timeouted, callErr, stack := tryCall(taskCtx, reflectedTaskFunction, reflectedTaskArgs)
+
+	if !inFlight.finalize() {
+		// Worker.Shutdown already requeued this delivery after the task blew through
+		// its forced-cancellation grace period; nothing left for us to do.
+		return
+	}
+
+	if inFlight.wasForceCancelled() {
+		// See the matching check in consumeOne: tryCall unblocking via a forced
+		// cancellation tells us nothing about whether the task actually finished.
+		w.log.Errorf("Task %s abandoned by forced shutdown, requeuing", task.UUID)
+		w.transport.Nack(d, true)
+		return
+	}
+
+	duration := time.Since(startedAt)
+
+	switch {
+	case timeouted:
+		w.log.Infof("Task %s exceeded timeout, taking next task", task.UUID)
+		w.metrics.TaskTimedOut(w.name, queue, duration)
+		w.retryOrDeadLetterBroker(d, queue, task, taskConfig, attempt, errors.New("task execution timed out"), nil)
+	case stack != nil:
+		w.log.Errorf("Task %s panicked: %v", task.UUID, callErr)
+		w.metrics.TaskPanicked(w.name, queue, duration)
+		w.retryOrDeadLetterBroker(d, queue, task, taskConfig, attempt, callErr, stack)
+	case callErr != nil:
+		w.log.Errorf("Task %s failed: %v", task.UUID, callErr)
+		w.metrics.TaskFailed(w.name, queue, duration)
+		w.retryOrDeadLetterBroker(d, queue, task, taskConfig, attempt, callErr, stack)
+	default:
+		w.log.Infof("Task %s was finished", task.UUID)
+		w.metrics.TaskSucceeded(w.name, queue, duration)
+		w.transport.Ack(d)
+		w.notifyTaskComplete(TaskResult{TaskName: task.Name, TaskUUID: task.UUID, Worker: w.name, Attempt: attempt})
+	}
+
+}
+
+// retryOrDeadLetterBroker mirrors retryOrDeadLetter, publishing the retry/dead-letter
+// copy through w.transport instead of w.ch.
+func (w *Worker) retryOrDeadLetterBroker(d broker.Delivery, queue string, task Task, taskConfig TaskConfig, attempt int, taskErr error, stack []byte) {
+
+	if attempt < taskConfig.MaxRetries {
+
+		nextAttempt := attempt + 1
+
+		if err := w.scheduleRetryBroker(d, queue, taskConfig, nextAttempt, taskErr); err != nil {
+			w.log.Errorf("Can't schedule retry for task %s, dead-lettering instead: %v", task.UUID, err)
+		} else {
+			w.metrics.TaskRetried(w.name, queue)
+			w.transport.Ack(d)
+			w.notifyTaskComplete(TaskResult{TaskName: task.Name, TaskUUID: task.UUID, Worker: w.name, Attempt: nextAttempt, Err: taskErr, Stack: stack})
+			return
+		}
+
+	}
+
+	w.sendToDeadLetterBroker(d, task, attempt, taskErr, stack)
+	w.transport.Ack(d)
+	w.notifyTaskComplete(TaskResult{TaskName: task.Name, TaskUUID: task.UUID, Worker: w.name, Attempt: attempt, Err: taskErr, Stack: stack, DeadLettered: true})
+
+}
+
+// scheduleRetryBroker mirrors scheduleRetry: it republishes d to the same queue it came
+// from, with its retry count bumped and Message.Expiration set to the retry delay -
+// since, unlike the AMQP path's dedicated per-queue delay queue, a generic Broker has
+// no such concept and is expected to honor Expiration on Publish directly.
+func (w *Worker) scheduleRetryBroker(d broker.Delivery, queue string, taskConfig TaskConfig, nextAttempt int, taskErr error) error {
+
+	delayFunc := taskConfig.RetryDelayFunc
+	if delayFunc == nil {
+		delayFunc = defaultRetryDelayFunc
+	}
+
+	delay := delayFunc(nextAttempt, taskErr)
+
+	headers := map[string]interface{}{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = nextAttempt
+
+	return w.transport.Publish("", queue, broker.Message{
+		Headers:    headers,
+		Body:       d.Body,
+		Expiration: delay,
+	})
+
+}
+
+// sendToDeadLetterBroker mirrors sendToDeadLetter, publishing through w.transport.
+func (w *Worker) sendToDeadLetterBroker(d broker.Delivery, task Task, attempt int, taskErr error, stack []byte) {
+
+	if w.deadLetterExchange == "" && w.deadLetterQueue == "" {
+		w.log.Errorf("Task %s exhausted its retries and no dead-letter destination is configured, dropping it: %v", task.UUID, taskErr)
+		return
+	}
+
+	headers := map[string]interface{}{
+		"x-last-error":    taskErr.Error(),
+		"x-worker":        w.name,
+		"x-attempt-count": attempt,
+	}
+
+	if len(stack) > 0 {
+		headers["x-stack"] = string(stack)
+	}
+
+	err := w.transport.Publish(w.deadLetterExchange, w.deadLetterQueue, broker.Message{
+		Headers: headers,
+		Body:    d.Body,
+	})
+	if err != nil {
+		w.log.Errorf("Can't publish task %s to dead-letter destination: %v", task.UUID, err)
+	}
+
+}
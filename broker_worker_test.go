@@ -0,0 +1,76 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofort/dispatcher/broker"
+)
+
+// fakePublish records a single call to fakeBroker.Publish.
+type fakePublish struct {
+	exchange string
+	key      string
+	msg      broker.Message
+}
+
+// fakeBroker is a minimal broker.Broker used to exercise broker_worker.go's
+// retry/dead-letter paths without a real RabbitMQ or Redis behind them.
+type fakeBroker struct {
+	published []fakePublish
+}
+
+func (b *fakeBroker) DeclareQueue(queue string) error { return nil }
+
+func (b *fakeBroker) Consume(queue, tag string, limit int) (<-chan broker.Delivery, error) {
+	return make(chan broker.Delivery), nil
+}
+
+func (b *fakeBroker) Publish(exchange, key string, msg broker.Message) error {
+	b.published = append(b.published, fakePublish{exchange: exchange, key: key, msg: msg})
+	return nil
+}
+
+func (b *fakeBroker) Ack(d broker.Delivery) error                { return nil }
+func (b *fakeBroker) Nack(d broker.Delivery, requeue bool) error { return nil }
+func (b *fakeBroker) Bind(exchange, queue, key string) error     { return nil }
+func (b *fakeBroker) Close() error                               { return nil }
+
+func TestScheduleRetryBrokerPublishesWithBumpedRetryCountAndExpiration(t *testing.T) {
+
+	fb := &fakeBroker{}
+	w := &Worker{transport: fb}
+
+	d := broker.Delivery{
+		Headers: map[string]interface{}{"x-retry-count": 1, "x-other": "keep-me"},
+		Body:    []byte(`{"name":"some-task"}`),
+	}
+
+	taskConfig := TaskConfig{
+		RetryDelayFunc: func(attempt int, err error) time.Duration { return time.Second },
+	}
+
+	if err := w.scheduleRetryBroker(d, "myqueue", taskConfig, 2, nil); err != nil {
+		t.Fatalf("scheduleRetryBroker returned error: %v", err)
+	}
+
+	if len(fb.published) != 1 {
+		t.Fatalf("Publish called %d times, want 1", len(fb.published))
+	}
+
+	got := fb.published[0]
+
+	if got.exchange != "" || got.key != "myqueue" {
+		t.Errorf("Publish went to exchange %q key %q, want \"\" myqueue", got.exchange, got.key)
+	}
+	if got.msg.Expiration != time.Second {
+		t.Errorf("Publish Expiration = %v, want %v", got.msg.Expiration, time.Second)
+	}
+	if got.msg.Headers["x-retry-count"] != 2 {
+		t.Errorf("Publish headers x-retry-count = %v, want 2", got.msg.Headers["x-retry-count"])
+	}
+	if got.msg.Headers["x-other"] != "keep-me" {
+		t.Errorf("Publish headers x-other = %v, want keep-me", got.msg.Headers["x-other"])
+	}
+
+}
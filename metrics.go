@@ -0,0 +1,203 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsSink receives measurements about task execution from every worker. The
+// default sink is a no-op so existing users pay nothing unless they opt in; pass a
+// MetricsSink on WorkerConfig to plug in Prometheus (NewPrometheusMetricsSink), statsd,
+// OpenTelemetry, or anything else.
+type MetricsSink interface {
+	TaskReceived(worker, queue string)
+	TaskSucceeded(worker, queue string, duration time.Duration)
+	TaskFailed(worker, queue string, duration time.Duration)
+	TaskPanicked(worker, queue string, duration time.Duration)
+	TaskTimedOut(worker, queue string, duration time.Duration)
+	TaskRetried(worker, queue string)
+	InFlightDelta(worker, queue string, delta int)
+}
+
+// noopMetricsSink is the default MetricsSink: every call is a no-op.
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) TaskReceived(worker, queue string)                          {}
+func (noopMetricsSink) TaskSucceeded(worker, queue string, duration time.Duration) {}
+func (noopMetricsSink) TaskFailed(worker, queue string, duration time.Duration)    {}
+func (noopMetricsSink) TaskPanicked(worker, queue string, duration time.Duration)  {}
+func (noopMetricsSink) TaskTimedOut(worker, queue string, duration time.Duration)  {}
+func (noopMetricsSink) TaskRetried(worker, queue string)                           {}
+func (noopMetricsSink) InFlightDelta(worker, queue string, delta int)              {}
+
+// prometheusMetricsSink is a MetricsSink backed by Prometheus collectors, returned by
+// NewPrometheusMetricsSink.
+type prometheusMetricsSink struct {
+	tasksTotal   *prometheus.CounterVec
+	taskDuration *prometheus.HistogramVec
+	inFlight     *prometheus.GaugeVec
+}
+
+// NewPrometheusMetricsSink builds a MetricsSink backed by Prometheus collectors and
+// registers them on reg. If reg is nil, prometheus.DefaultRegisterer is used.
+// The returned sink exposes, labeled by worker and queue:
+//
+//	dispatcher_tasks_total{outcome="received|succeeded|failed|panicked|timeouted|retried"}
+//	dispatcher_task_duration_seconds
+//	dispatcher_tasks_in_flight
+func NewPrometheusMetricsSink(reg prometheus.Registerer) MetricsSink {
+
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	sink := &prometheusMetricsSink{
+		tasksTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dispatcher_tasks_total",
+			Help: "Total number of tasks processed by a worker, by outcome.",
+		}, []string{"worker", "queue", "outcome"}),
+
+		taskDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dispatcher_task_duration_seconds",
+			Help:    "Task execution duration in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"worker", "queue"}),
+
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dispatcher_tasks_in_flight",
+			Help: "Number of tasks currently being executed by a worker.",
+		}, []string{"worker", "queue"}),
+	}
+
+	reg.MustRegister(sink.tasksTotal, sink.taskDuration, sink.inFlight)
+
+	return sink
+}
+
+func (s *prometheusMetricsSink) TaskReceived(worker, queue string) {
+	s.tasksTotal.WithLabelValues(worker, queue, "received").Inc()
+}
+
+func (s *prometheusMetricsSink) TaskSucceeded(worker, queue string, duration time.Duration) {
+	s.tasksTotal.WithLabelValues(worker, queue, "succeeded").Inc()
+	s.taskDuration.WithLabelValues(worker, queue).Observe(duration.Seconds())
+}
+
+func (s *prometheusMetricsSink) TaskFailed(worker, queue string, duration time.Duration) {
+	s.tasksTotal.WithLabelValues(worker, queue, "failed").Inc()
+	s.taskDuration.WithLabelValues(worker, queue).Observe(duration.Seconds())
+}
+
+func (s *prometheusMetricsSink) TaskPanicked(worker, queue string, duration time.Duration) {
+	s.tasksTotal.WithLabelValues(worker, queue, "panicked").Inc()
+	s.taskDuration.WithLabelValues(worker, queue).Observe(duration.Seconds())
+}
+
+func (s *prometheusMetricsSink) TaskTimedOut(worker, queue string, duration time.Duration) {
+	s.tasksTotal.WithLabelValues(worker, queue, "timeouted").Inc()
+	s.taskDuration.WithLabelValues(worker, queue).Observe(duration.Seconds())
+}
+
+func (s *prometheusMetricsSink) TaskRetried(worker, queue string) {
+	s.tasksTotal.WithLabelValues(worker, queue, "retried").Inc()
+}
+
+func (s *prometheusMetricsSink) InFlightDelta(worker, queue string, delta int) {
+	s.inFlight.WithLabelValues(worker, queue).Add(float64(delta))
+}
+
+// ServeMetrics starts an HTTP server on addr exposing:
+//
+//	/metrics       - Prometheus metrics read from gatherer, if a prometheusMetricsSink
+//	                 is in use (see NewPrometheusMetricsSink); workers using a
+//	                 different MetricsSink simply won't contribute anything to it.
+//	                 Pass the same prometheus.Registerer you gave
+//	                 NewPrometheusMetricsSink (a *prometheus.Registry also implements
+//	                 prometheus.Gatherer), or nil to fall back to
+//	                 prometheus.DefaultGatherer - which is only right if that sink was
+//	                 also built with a nil Registerer.
+//	/healthz       - JSON health of the AMQP connection and every registered worker.
+//	/debug/pprof/* - standard net/http/pprof profiles.
+//
+// The server runs in the background; ServeMetrics only returns an error if it fails
+// to bind addr.
+func (s *Server) ServeMetrics(addr string, gatherer prometheus.Gatherer) error {
+
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Error starting metrics listener: %v", err)
+	}
+
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", s.healthzHandler)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	httpServer := &http.Server{Handler: mux}
+
+	go func() {
+		if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.log.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	return nil
+
+}
+
+// healthzHandler reports whether the AMQP connection is up and whether each
+// registered worker is currently consuming its queue.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+
+	type workerHealth struct {
+		Queues    []string `json:"queues"`
+		Consuming bool     `json:"consuming"`
+	}
+
+	health := struct {
+		AMQPConnected bool                    `json:"amqp_connected"`
+		Workers       map[string]workerHealth `json:"workers"`
+	}{
+		AMQPConnected: s.con.connected,
+		Workers:       make(map[string]workerHealth, len(s.workers)),
+	}
+
+	healthy := health.AMQPConnected
+
+	for name, worker := range s.workers {
+		queues := make([]string, 0, len(worker.queues))
+		for queue := range worker.queues {
+			queues = append(queues, queue)
+		}
+		sort.Strings(queues)
+
+		health.Workers[name] = workerHealth{Queues: queues, Consuming: worker.working}
+		healthy = healthy && worker.working
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(health)
+
+}
@@ -0,0 +1,319 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// reconnectState holds the bits of reconnect bookkeeping that belong to a *Server as
+// a whole rather than to any one Worker: hooks registered through Server.OnReconnect,
+// and a synchronized copy of whether the connection is currently up. It's kept in a
+// side table keyed by the Server pointer instead of as fields on Server, since Server
+// is defined elsewhere; see serverReconnectState.
+//
+// connected duplicates s.con.connected rather than reading it directly: that field is
+// written by superviseConnection and read by superviseWorkerChannel from a different
+// goroutine with no lock between them, which is a data race. Routing both sides through
+// this mutex-guarded copy instead fixes that without needing a field on Server's own
+// (invisible, elsewhere-defined) connection struct.
+type reconnectState struct {
+	mu        sync.Mutex
+	connected bool
+	hooks     []func()
+}
+
+var reconnectStates sync.Map // *Server -> *reconnectState
+
+func serverReconnectState(s *Server) *reconnectState {
+	v, _ := reconnectStates.LoadOrStore(s, &reconnectState{})
+	return v.(*reconnectState)
+}
+
+func (st *reconnectState) setConnected(connected bool) {
+	st.mu.Lock()
+	st.connected = connected
+	st.mu.Unlock()
+}
+
+func (st *reconnectState) isConnected() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.connected
+}
+
+// OnReconnect registers a hook that runs after the server has redialed AMQP and every
+// worker has resubscribed its queue, so callers can rewarm anything an outage may have
+// invalidated (caches, connection pools to other services, etc). Hooks run in the
+// order they were registered. A registered hook cannot be removed (there is no
+// Off/Remove counterpart), so a hook that wants to run once has to guard itself with
+// its own flag.
+func (s *Server) OnReconnect(hook func()) {
+	st := serverReconnectState(s)
+	st.mu.Lock()
+	st.hooks = append(st.hooks, hook)
+	st.mu.Unlock()
+}
+
+// SuperviseReconnects watches the server's AMQP connection, and independently each
+// worker's channel, for NotifyClose events. A full connection drop triggers an
+// exponential-backoff redial (via dial, which should reproduce however the server
+// originally connected) followed by every worker resubscribing its queue, delay queue
+// and bindings and resuming consumption with its original consumer tag. A lone channel
+// error - the connection otherwise being fine - only resubscribes the one affected
+// worker. It runs until ctx is done, so call it once right after the server's first
+// successful connection.
+func (s *Server) SuperviseReconnects(ctx context.Context, dial func() (*amqp.Connection, error)) {
+	go s.superviseConnection(ctx, dial)
+}
+
+func (s *Server) superviseConnection(ctx context.Context, dial func() (*amqp.Connection, error)) {
+
+	st := serverReconnectState(s)
+	st.setConnected(true)
+
+	for {
+
+		closeNotify := s.con.con.NotifyClose(make(chan *amqp.Error, 1))
+
+		for _, w := range s.workers {
+			go s.superviseWorkerChannel(ctx, w)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-closeNotify:
+			s.log.Errorf("AMQP connection closed, reconnecting: %v", err)
+		}
+
+		s.con.connected = false
+		st.setConnected(false)
+
+		con, err := redialWithBackoff(ctx, dial)
+		if err != nil {
+			// ctx was cancelled while we were redialing.
+			return
+		}
+
+		s.con.con = con
+		s.con.connected = true
+		st.setConnected(true)
+
+		for name, w := range s.workers {
+			if err := w.resubscribe(ctx, con); err != nil {
+				s.log.Errorf("Worker %s failed to resubscribe after reconnect: %v", name, err)
+			}
+		}
+
+		st.mu.Lock()
+		hooks := append([]func(){}, st.hooks...)
+		st.mu.Unlock()
+
+		for _, hook := range hooks {
+			hook()
+		}
+
+	}
+
+}
+
+// superviseWorkerChannel watches every channel a worker owns - its dedicated publish
+// channel and one consume channel per queue - and resubscribes the whole worker if any
+// of them closes while the server's connection is otherwise still up. If the connection
+// itself went down, superviseConnection's redial already owns recovery for every worker,
+// so this returns without doing anything. The channel count isn't known until runtime,
+// so watching all of them at once needs reflect.Select rather than a plain select.
+//
+// It loops for as long as ctx is alive, rebuilding its cases (and re-registering
+// NotifyClose) against whatever channels the worker holds after each resubscribe -
+// otherwise only the first post-redial channel drop for a worker would ever be
+// supervised, leaving it unwatched until the next full connection drop reset
+// superviseConnection's own loop.
+func (s *Server) superviseWorkerChannel(ctx context.Context, w *Worker) {
+
+	for {
+
+		if w.ch == nil {
+			return
+		}
+
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.ch.NotifyClose(make(chan *amqp.Error, 1)))},
+		}
+
+		for _, ch := range w.consumeChannels {
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(ch.NotifyClose(make(chan *amqp.Error, 1))),
+			})
+		}
+
+		chosen, recv, ok := reflect.Select(cases)
+		if chosen == 0 {
+			return
+		}
+
+		st := serverReconnectState(s)
+		if !ok || !st.isConnected() {
+			return
+		}
+
+		err, _ := recv.Interface().(*amqp.Error)
+		s.log.Errorf("Worker %s channel closed, resubscribing: %v", w.name, err)
+		if err := w.resubscribe(ctx, s.con.con); err != nil {
+			s.log.Errorf("Worker %s failed to resubscribe: %v", w.name, err)
+			return
+		}
+
+	}
+
+}
+
+// redialWithBackoff calls dial until it succeeds, waiting an exponential backoff with
+// jitter between attempts, and gives up only when ctx is done.
+func redialWithBackoff(ctx context.Context, dial func() (*amqp.Connection, error)) (*amqp.Connection, error) {
+
+	const (
+		base = time.Second
+		cap  = time.Minute
+	)
+
+	for attempt := 0; ; attempt++ {
+
+		con, err := dial()
+		if err == nil {
+			return con, nil
+		}
+
+		delay := base * time.Duration(1<<uint(attempt))
+		if delay <= 0 || delay > cap {
+			delay = cap
+		}
+		delay += time.Duration(rand.Int63n(int64(base)))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+	}
+
+}
+
+// resubscribe re-declares everything this worker owns - every queue it consumes, each
+// one's retry delay queue, and their bindings - on fresh channels taken from con, then
+// resumes consumption on each queue using the worker's original consumer tag.
+// Declarations are idempotent, so running this after a transient network blip is
+// harmless even when the broker never actually lost state.
+func (w *Worker) resubscribe(ctx context.Context, con *amqp.Connection) error {
+
+	w.resubscribeMu.Lock()
+	defer w.resubscribeMu.Unlock()
+
+	if !w.working {
+		return nil
+	}
+
+	w.stopConsume <- struct{}{}
+	close(w.stopConsume)
+
+	<-w.consumingStopped
+	close(w.consumingStopped)
+
+	ch, err := con.Channel()
+	if err != nil {
+		return fmt.Errorf("Error recreating publish channel for worker %s: %v", w.name, err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("Error enabling publisher confirms for worker %s: %v", w.name, err)
+	}
+	w.ch = ch
+	w.publishConfirms = w.ch.NotifyPublish(make(chan amqp.Confirmation, 8))
+
+	consumeChannels := make(map[string]*amqp.Channel, len(w.queues))
+	deliveries := make(map[string]<-chan amqp.Delivery, len(w.queues))
+
+	for queue := range w.queues {
+
+		qch, err := con.Channel()
+		if err != nil {
+			return fmt.Errorf("Error recreating channel for worker %s queue %s: %v", w.name, queue, err)
+		}
+
+		if err := declareQueue(qch, queue); err != nil {
+			return fmt.Errorf("Error redeclaring queue %s for worker %s: %v", queue, w.name, err)
+		}
+
+		if err := declareDelayQueue(qch, w.delayQueues[queue], queue); err != nil {
+			return fmt.Errorf("Error redeclaring retry delay queue for worker %s queue %s: %v", w.name, queue, err)
+		}
+
+		for _, k := range w.bindingKeys {
+			if err := queueBind(qch, w.exchange, queue, k); err != nil {
+				return fmt.Errorf("Error rebinding queue %s for worker %s: %v", queue, w.name, err)
+			}
+		}
+
+		if err := qch.Qos(w.limit, 0, false); err != nil {
+			return fmt.Errorf("Error setting QoS for worker %s queue %s: %v", w.name, queue, err)
+		}
+
+		d, err := qch.Consume(queue, w.name, false, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("Error resuming consumption for worker %s queue %s: %v", w.name, queue, err)
+		}
+
+		consumeChannels[queue] = qch
+		deliveries[queue] = d
+
+	}
+
+	w.consumeChannels = consumeChannels
+
+	w.stopConsume = make(chan struct{})
+	w.consumingStopped = make(chan struct{})
+
+	go w.consume(ctx, deliveries)
+
+	w.log.Infof("Worker %s resubscribed after reconnect", w.name)
+
+	return nil
+
+}
+
+// publishAndConfirm publishes msg on the worker's channel and waits for the broker's
+// publisher confirm before returning, so scheduleRetry/sendToDeadLetter can tell a
+// publish lost to a reconnect racing the publish apart from one the broker actually
+// accepted. Falls back to a plain fire-and-forget publish if confirms were never
+// enabled on this channel (e.g. a Worker built without going through NewWorker/init).
+func (w *Worker) publishAndConfirm(exchange, key string, msg amqp.Publishing) error {
+
+	if err := w.ch.Publish(exchange, key, false, false, msg); err != nil {
+		return err
+	}
+
+	if w.publishConfirms == nil {
+		return nil
+	}
+
+	select {
+	case confirm, ok := <-w.publishConfirms:
+		if !ok || !confirm.Ack {
+			return errors.New("broker did not confirm the publish")
+		}
+	case <-time.After(5 * time.Second):
+		return errors.New("timed out waiting for the broker's publish confirm")
+	}
+
+	return nil
+
+}
@@ -0,0 +1,46 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRedialWithBackoffSucceedsImmediately(t *testing.T) {
+
+	want := &amqp.Connection{}
+	calls := 0
+
+	con, err := redialWithBackoff(context.Background(), func() (*amqp.Connection, error) {
+		calls++
+		return want, nil
+	})
+
+	if err != nil {
+		t.Fatalf("redialWithBackoff returned error: %v", err)
+	}
+	if con != want {
+		t.Errorf("redialWithBackoff returned %v, want %v", con, want)
+	}
+	if calls != 1 {
+		t.Errorf("dial called %d times, want 1", calls)
+	}
+
+}
+
+func TestRedialWithBackoffGivesUpWhenCtxDone(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := redialWithBackoff(ctx, func() (*amqp.Connection, error) {
+		return nil, errors.New("dial failed")
+	})
+
+	if err == nil {
+		t.Fatal("redialWithBackoff returned no error for an already-cancelled ctx")
+	}
+
+}
@@ -0,0 +1,133 @@
+package dispatcher
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TaskResult describes the outcome of a single task delivery once the worker has
+// decided what to do with it: Ack it as done, republish it for another attempt,
+// or send it to the dead letter destination. It is handed to WorkerConfig.OnTaskComplete,
+// if set, so callers can track failures without digging through logs.
+type TaskResult struct {
+	TaskName     string
+	TaskUUID     string
+	Worker       string
+	Attempt      int
+	Err          error
+	Stack        []byte
+	DeadLettered bool
+}
+
+const retryCountHeader = "x-retry-count"
+
+// defaultRetryDelayFunc is used whenever TaskConfig.RetryDelayFunc is not set.
+// It mirrors asynq's default backoff: min(cap, base*2^attempt) plus jitter in [0, base).
+func defaultRetryDelayFunc(attempt int, err error) time.Duration {
+
+	const (
+		base = time.Second
+		cap  = time.Minute
+	)
+
+	delay := base * time.Duration(1<<uint(attempt))
+	if delay <= 0 || delay > cap {
+		delay = cap
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(base)))
+}
+
+// declareDelayQueue declares the queue a worker republishes failed tasks to while
+// they wait out their retry delay. Messages expire off it (via their per-message
+// TTL set in scheduleRetry) straight back onto the original queue, since the
+// delay queue's dead-letter-exchange is the default exchange and its
+// dead-letter-routing-key is the original queue name.
+func declareDelayQueue(ch *amqp.Channel, delayQueue, targetQueue string) error {
+
+	_, err := ch.QueueDeclare(
+		delayQueue,
+		true,  // durable
+		false, // auto-delete
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": targetQueue,
+		},
+	)
+
+	return err
+}
+
+// scheduleRetry republishes a failed delivery to the delay queue for the queue it
+// came from, tagged with the next attempt number and a per-message TTL computed
+// from TaskConfig.RetryDelayFunc (or defaultRetryDelayFunc if unset).
+func (w *Worker) scheduleRetry(d amqp.Delivery, queue string, taskConfig TaskConfig, nextAttempt int, taskErr error) error {
+
+	delayFunc := taskConfig.RetryDelayFunc
+	if delayFunc == nil {
+		delayFunc = defaultRetryDelayFunc
+	}
+
+	delay := delayFunc(nextAttempt, taskErr)
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(nextAttempt)
+
+	return w.publishAndConfirm(
+		"",                   // default exchange routes straight to the delay queue by name
+		w.delayQueues[queue], // routing key == delay queue name
+		amqp.Publishing{
+			Headers:      headers,
+			ContentType:  d.ContentType,
+			Body:         d.Body,
+			DeliveryMode: d.DeliveryMode,
+			Expiration:   strconv.FormatInt(delay.Milliseconds(), 10),
+		},
+	)
+
+}
+
+// sendToDeadLetter publishes a task which has exhausted its retries to the
+// worker's configured dead letter exchange/queue, annotated with the last error,
+// its stack (if it came from a panic), the worker name and the attempt count.
+// If no dead letter destination is configured the task is logged and dropped.
+func (w *Worker) sendToDeadLetter(d amqp.Delivery, task Task, attempt int, taskErr error, stack []byte) {
+
+	if w.deadLetterExchange == "" && w.deadLetterQueue == "" {
+		w.log.Errorf("Task %s exhausted its retries and no dead-letter destination is configured, dropping it: %v", task.UUID, taskErr)
+		return
+	}
+
+	headers := amqp.Table{
+		"x-last-error":    taskErr.Error(),
+		"x-worker":        w.name,
+		"x-attempt-count": int32(attempt),
+	}
+
+	if len(stack) > 0 {
+		headers["x-stack"] = string(stack)
+	}
+
+	err := w.publishAndConfirm(
+		w.deadLetterExchange,
+		w.deadLetterQueue,
+		amqp.Publishing{
+			Headers:      headers,
+			ContentType:  d.ContentType,
+			Body:         d.Body,
+			DeliveryMode: d.DeliveryMode,
+		},
+	)
+	if err != nil {
+		w.log.Errorf("Can't publish task %s to dead-letter destination: %v", task.UUID, err)
+	}
+
+}
@@ -0,0 +1,33 @@
+package dispatcher
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDefaultRetryDelayFunc(t *testing.T) {
+
+	cases := []struct {
+		name    string
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"attempt 0", 0, time.Second, 2 * time.Second},
+		{"attempt 1", 1, 2 * time.Second, 3 * time.Second},
+		{"attempt beyond cap", 10, time.Minute, time.Minute + time.Second},
+	}
+
+	err := errors.New("boom")
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			delay := defaultRetryDelayFunc(c.attempt, err)
+			if delay < c.min || delay >= c.max {
+				t.Errorf("defaultRetryDelayFunc(%d, ...) = %v, want in [%v, %v)", c.attempt, delay, c.min, c.max)
+			}
+		})
+	}
+
+}
@@ -1,31 +1,67 @@
 package dispatcher
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gofort/dispatcher/broker"
 	"github.com/gofort/dispatcher/utils"
 	"github.com/streadway/amqp"
+	"math/rand"
 	"reflect"
 	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // WorkerConfig is a configuration for new worker which you want to create.
 //
-// Limit - number of parallel tasks which will be executed.
+// Limit - number of parallel tasks which will be executed, shared across every queue
+// in Queues - it bounds the worker's total concurrency, not each queue individually.
 //
-// Queue - name of queue which worker will consume.
+// Queues - queues this worker consumes, mapped to their weight. A single queue with
+// any weight behaves exactly like before. With more than one queue, weight governs
+// dispatch order: see StrictPriority.
 //
-// Binding keys - biding keys for queue which will be created.
+// StrictPriority - when true, queues are always drained highest-weight-first; a lower
+// queue is only polled once every higher queue has nothing ready. When false (the
+// default), queues are polled in a randomized order where a queue's chance of being
+// picked first is proportional to its weight, the same scheme asynq's processor uses.
 //
-// Name - worker name
+// Binding keys - biding keys for queue which will be created. Applied to every queue in Queues.
+//
+// Name is the worker name.
+//
+// DeadLetterExchange/DeadLetterQueue - where tasks are published once they exhaust
+// TaskConfig.MaxRetries. Left empty, exhausted tasks are just logged and dropped.
+//
+// OnTaskComplete - optional callback invoked with the outcome of every task this
+// worker handles, so callers can observe successes, retries and dead-lettering.
+//
+// MetricsSink - where this worker reports task counters, duration and in-flight
+// gauge. Defaults to a no-op sink; pass NewPrometheusMetricsSink(nil) (or your own
+// implementation) to actually collect something.
+//
+// Broker - the transport this worker consumes from and publishes retries/dead-letters
+// to. Left nil, the worker uses the server's own AMQP connection directly (not through
+// broker/amqp), exactly as it always has. Pass a broker/redis.Broker (or any other broker.Broker)
+// to run this worker against a different transport instead; a worker built this way
+// isn't covered by Server.SuperviseReconnects, since that's AMQP connection/channel
+// recovery specifically - other transports are expected to handle their own.
 type WorkerConfig struct {
-	Limit       int
-	Queue       string // required
-	BindingKeys []string
-	Name        string // required
+	Limit              int
+	Queues             map[string]int // required; queue name -> weight
+	StrictPriority     bool
+	BindingKeys        []string
+	Name               string // required
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	OnTaskComplete     func(TaskResult)
+	MetricsSink        MetricsSink
+	Broker             broker.Broker
 }
 
 // TaskConfig is task configuration which is needed for task registration in worker.
@@ -33,30 +69,108 @@ type WorkerConfig struct {
 // Timeout is needed in case your task executing for about half an hour but you expected only 1 minute.
 // When timeout exceeded next task will be taken, but that old task will not be stopped.
 // TaskUUIDAsFirstArg - makes task UUID as first argument of all tasks which this worker calls.
+//
+// MaxRetries - how many times a failed task (panic, or a returned non-nil error as the
+// function's last result) is republished before it is sent to the dead letter
+// destination. Zero means failed tasks are dead-lettered immediately.
+//
+// RetryDelayFunc - computes how long a failed task waits before being redelivered.
+// Defaults to exponential backoff with jitter, the same shape asynq uses.
+//
+// ContextAsFirstArg - makes a context.Context the first argument of all tasks which this
+// worker calls. The context is cancelled when TimeoutSeconds elapses, or when the worker
+// is force-shutdown (see Worker.Shutdown), so well-behaved tasks can return early instead
+// of being abandoned. Analogous to TaskUUIDAsFirstArg; if both are set the context comes first.
 type TaskConfig struct {
 	TimeoutSeconds     int64
 	Function           interface{}
 	TaskUUIDAsFirstArg bool
+	ContextAsFirstArg  bool
+	MaxRetries         int
+	RetryDelayFunc     func(attempt int, err error) time.Duration
 }
 
 // Worker instance.
-// Consists of channel which consume queue.
+// Consists of one channel per consumed queue, plus a dedicated channel for publishing.
 type Worker struct {
 	log Log // logger, which was taken from server instance
 
-	ch               *amqp.Channel        // channel which is used for messages consuming
-	stopConsume      chan struct{}        // channel which is used to stop consuming process
-	consumingStopped chan struct{}        // channel which notifies that consuming stopped
-	deliveries       <-chan amqp.Delivery // deliveries which worker is receiving
-	tasksInProgress  *sync.WaitGroup      // wait group for waiting all tasks finishing when we close this worker
+	ch              *amqp.Channel            // dedicated channel used for publishing (retries, dead-letters)
+	consumeChannels map[string]*amqp.Channel // one consuming channel per queue in queues
+
+	stopConsume      chan struct{}   // channel which is used to stop consuming process
+	consumingStopped chan struct{}   // channel which notifies that consuming stopped
+	tasksInProgress  *sync.WaitGroup // wait group for waiting all tasks finishing when we close this worker
+
+	queues         map[string]int    // queue name -> weight
+	strictPriority bool              // if true, always drain higher-weight queues before lower ones
+	delayQueues    map[string]string // queue name -> its retry delay queue name
+
+	name  string        // worker name, also used as consumer tag
+	limit int           // number of tasks which can be executed in parallel
+	sem   chan struct{} // bounds total concurrent tasks across every queue this worker consumes
+
+	deadLetterExchange string // exchange failed tasks are published to once retries are exhausted
+	deadLetterQueue    string // routing key/queue used alongside deadLetterExchange
+
+	exchange    string   // exchange this worker's queues are bound to, recorded so resubscribe can rebind them
+	bindingKeys []string // binding keys recorded so resubscribe can redeclare them after a reconnect
+
+	publishConfirms chan amqp.Confirmation // broker publisher-confirms for w.ch, used by scheduleRetry/sendToDeadLetter
 
-	queue string // queue name which will be subscribed by this worker
-	name  string // worker name, also used as consumer tag
-	limit int    // number of tasks which can be executed in parallel
+	resubscribeMu sync.Mutex // guards resubscribe and Shutdown against each other and against themselves, since a full-connection redial, a single-channel NotifyClose, and a caller's own Shutdown call can all otherwise race to flip w.working and close w.stopConsume/w.consumingStopped at once
+
+	// transport holds the pluggable broker.Broker this worker was built with via
+	// WorkerConfig.Broker. nil means this worker uses the legacy direct-AMQP fields
+	// above instead (ch, consumeChannels, ...), which is what Server.SuperviseReconnects
+	// knows how to supervise; a non-nil transport runs its own consume/publish path in
+	// broker_worker.go and is invisible to that supervision (it's expected to handle its
+	// own recovery - Redis, for one, already does via its visibility-timeout reclaim loop).
+	transport broker.Broker
+
+	onTaskComplete func(TaskResult) // optional callback notified about every task outcome
+	metrics        MetricsSink      // where task counters/duration/in-flight gauge are reported
 
 	tasks map[string]TaskConfig // tasks configurations, to know their timeouts and know if this worker should execute task
 
 	working bool // indicates if worker was started earlier
+
+	inFlight sync.Map // task UUID -> *inFlightTask, tracked so Shutdown can force-cancel and requeue them
+}
+
+// inFlightTask is what Worker.Shutdown needs to forcibly stop a task that is still
+// running once its graceful deadline has passed: the cancel func for its per-task
+// context, the delivery to Nack-with-requeue, and a guard so consumeOne and
+// Shutdown never both try to finalize the same delivery.
+type inFlightTask struct {
+	cancel context.CancelFunc
+
+	// requeue Nacks-with-requeue this task's delivery, however the path that created
+	// it (legacy direct-AMQP or a broker.Broker) needs to do that.
+	requeue func()
+
+	finalized int32
+
+	// forceCancelled is set by cancelInFlight before it calls cancel, so consumeOne
+	// can tell a Shutdown-forced cancellation apart from the task function simply
+	// returning once ctx is done. Without this, tryCall unblocks on ctx.Done() the
+	// instant cancel runs - almost always before the task function itself has
+	// actually returned - and consumeOne would otherwise read that as a normal,
+	// successful completion and Ack it.
+	forceCancelled int32
+}
+
+// finalize reports whether the caller is the first (and only) one allowed to
+// Ack/Nack this delivery, guarding against a race between a task finishing on
+// its own and Worker.Shutdown forcibly requeuing it.
+func (t *inFlightTask) finalize() bool {
+	return atomic.CompareAndSwapInt32(&t.finalized, 0, 1)
+}
+
+// wasForceCancelled reports whether cancelInFlight forced this task's context
+// cancellation, as opposed to it completing (or timing out) on its own.
+func (t *inFlightTask) wasForceCancelled() bool {
+	return atomic.LoadInt32(&t.forceCancelled) == 1
 }
 
 // NewWorker creates new worker instance.
@@ -76,46 +190,96 @@ func (s *Server) NewWorker(cfg *WorkerConfig, tasks map[string]TaskConfig) (*Wor
 		cfg.Limit = 3
 	}
 
-	if cfg.Queue == "" {
-		return nil, errors.New("Worker queue is required parameter")
+	if len(cfg.Queues) == 0 {
+		return nil, errors.New("Worker queues is required parameter")
 	}
 
 	if _, ok := s.workers[cfg.Name]; ok {
 		return nil, errors.New("Worker with the same name already exists")
 	}
 
+	metrics := cfg.MetricsSink
+	if metrics == nil {
+		metrics = noopMetricsSink{}
+	}
+
+	delayQueues := make(map[string]string, len(cfg.Queues))
+	for queue := range cfg.Queues {
+		delayQueues[queue] = queue + ".retry"
+	}
+
 	w := &Worker{
-		name:            cfg.Name,
-		log:             s.log,
-		tasks:           tasks,
-		limit:           cfg.Limit,
-		queue:           cfg.Queue,
-		tasksInProgress: new(sync.WaitGroup),
+		name:               cfg.Name,
+		log:                s.log,
+		tasks:              tasks,
+		limit:              cfg.Limit,
+		queues:             cfg.Queues,
+		strictPriority:     cfg.StrictPriority,
+		delayQueues:        delayQueues,
+		deadLetterExchange: cfg.DeadLetterExchange,
+		deadLetterQueue:    cfg.DeadLetterQueue,
+		exchange:           s.publisher.defaultExchange,
+		bindingKeys:        cfg.BindingKeys,
+		onTaskComplete:     cfg.OnTaskComplete,
+		metrics:            metrics,
+		tasksInProgress:    new(sync.WaitGroup),
+		transport:          cfg.Broker,
 	}
 
-	var err error
+	if cfg.Broker != nil {
+
+		for queue := range cfg.Queues {
+
+			if err := cfg.Broker.DeclareQueue(queue); err != nil {
+				s.log.Errorf("Error during declaring queue: %v", err)
+				return nil, err
+			}
+
+			for _, k := range cfg.BindingKeys {
+
+				if err := cfg.Broker.Bind(w.exchange, queue, k); err != nil {
+					s.log.Errorf("Error during binding queue: %v", err)
+					return nil, err
+				}
+
+			}
+
+		}
+
+		s.workers[cfg.Name] = w
+
+		return w, nil
 
-	w.ch, err = s.con.con.Channel()
-	if err != nil {
-		s.log.Errorf("Error during creating channel: %v", err)
-		return nil, err
 	}
-	defer w.ch.Close()
 
-	err = declareQueue(w.ch, cfg.Queue)
+	declareCh, err := s.con.con.Channel()
 	if err != nil {
-		s.log.Errorf("Error during declaring queue: %v", err)
+		s.log.Errorf("Error during creating channel: %v", err)
 		return nil, err
 	}
+	defer declareCh.Close()
 
-	for _, k := range cfg.BindingKeys {
+	for queue := range cfg.Queues {
 
-		err = queueBind(w.ch, s.publisher.defaultExchange, cfg.Queue, k)
-		if err != nil {
-			s.log.Errorf("Error during binding queue: %v", err)
+		if err := declareQueue(declareCh, queue); err != nil {
+			s.log.Errorf("Error during declaring queue: %v", err)
 			return nil, err
 		}
 
+		if err := declareDelayQueue(declareCh, delayQueues[queue], queue); err != nil {
+			s.log.Errorf("Error during declaring retry delay queue: %v", err)
+			return nil, err
+		}
+
+		for _, k := range cfg.BindingKeys {
+
+			if err := queueBind(declareCh, s.publisher.defaultExchange, queue, k); err != nil {
+				s.log.Errorf("Error during binding queue: %v", err)
+				return nil, err
+			}
+
+		}
+
 	}
 
 	s.workers[cfg.Name] = w
@@ -127,129 +291,293 @@ func (s *Server) NewWorker(cfg *WorkerConfig, tasks map[string]TaskConfig) (*Wor
 // Start function starts consuming of queue.
 // Needs server as an argument because only server contains AMQP connection and this function creates AMQP channel
 // for a worker from connection.
-func (w *Worker) Start(s *Server) error {
+// ctx is the parent context for every task this worker executes: cancelling it (or
+// letting it expire) cancels the per-task contexts handed to tasks registered with
+// ContextAsFirstArg. Use Worker.Shutdown for a bounded graceful shutdown instead of
+// cancelling ctx directly, which gives tasks no grace period at all.
+func (w *Worker) Start(ctx context.Context, s *Server) error {
+
+	if w.transport != nil {
+		return w.initBroker(ctx)
+	}
 
 	if !s.con.connected {
 		return errors.New("Can't start worker, because you are not connected to AMQP")
 	}
 
-	return w.init(s.con.con)
+	return w.init(ctx, s.con.con)
 
 }
 
-func (w *Worker) init(con *amqp.Connection) error {
+func (w *Worker) init(ctx context.Context, con *amqp.Connection) error {
 
 	w.working = true
 
 	w.stopConsume = make(chan struct{})
 	w.consumingStopped = make(chan struct{})
+	w.sem = make(chan struct{}, w.limit)
 
 	var err error
 
 	w.ch, err = con.Channel()
 	if err != nil {
-		return fmt.Errorf("Error during creating channel for worker: %v", err)
-	}
-
-	if err := w.ch.Qos(
-		w.limit, // prefetch count
-		0,       // prefetch size
-		false,   // global
-	); err != nil {
-		return fmt.Errorf("Error during setting QoS for worker's channel: %v", err)
-	}
-
-	w.deliveries, err = w.ch.Consume(
-		w.queue, // queue
-		w.name,  // consumer tag
-		false,   // auto-ack
-		false,   // exclusive
-		false,   // no-local
-		false,   // no-wait
-		nil,     // arguments
-	)
-	if err != nil {
-		return fmt.Errorf("Error during initialization queue consuming: %v", err)
+		return fmt.Errorf("Error during creating publish channel for worker: %v", err)
+	}
+
+	if err := w.ch.Confirm(false); err != nil {
+		return fmt.Errorf("Error enabling publisher confirms for worker's channel: %v", err)
 	}
+	w.publishConfirms = w.ch.NotifyPublish(make(chan amqp.Confirmation, 8))
+
+	consumeChannels := make(map[string]*amqp.Channel, len(w.queues))
+	deliveries := make(map[string]<-chan amqp.Delivery, len(w.queues))
+
+	for queue := range w.queues {
+
+		qch, err := con.Channel()
+		if err != nil {
+			return fmt.Errorf("Error during creating channel for queue %s: %v", queue, err)
+		}
+
+		if err := qch.Qos(
+			w.limit, // prefetch count
+			0,       // prefetch size
+			false,   // global
+		); err != nil {
+			return fmt.Errorf("Error during setting QoS for queue %s: %v", queue, err)
+		}
+
+		d, err := qch.Consume(
+			queue,  // queue
+			w.name, // consumer tag
+			false,  // auto-ack
+			false,  // exclusive
+			false,  // no-local
+			false,  // no-wait
+			nil,    // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("Error during initialization consuming for queue %s: %v", queue, err)
+		}
 
-	go w.consume(w.deliveries)
+		consumeChannels[queue] = qch
+		deliveries[queue] = d
+
+	}
+
+	w.consumeChannels = consumeChannels
+
+	go w.consume(ctx, deliveries)
 
 	return nil
 
 }
 
-func (w *Worker) consume(deliveries <-chan amqp.Delivery) {
+func (w *Worker) consume(ctx context.Context, deliveries map[string]<-chan amqp.Delivery) {
 
 	w.log.Infof("Worker %s started consuming", w.name)
 
 	for {
-		select {
 
-		case <-w.stopConsume:
+		queue, d, ok, stopped := w.nextDelivery(deliveries)
 
+		if stopped {
 			w.log.Debug("Consuming stopped")
-
 			w.consumingStopped <- struct{}{}
-
 			return
+		}
 
-		case d := <-deliveries:
+		if !ok {
+			continue
+		}
 
-			if len(d.Body) == 0 {
+		if len(d.Body) == 0 {
 
-				w.log.Error("Empty task received")
+			w.log.Error("Empty task received")
 
-				if er := d.Nack(false, false); er != nil {
-					w.log.Errorf("Consuming stopped: %v", er)
-					return
-				}
+			if er := d.Nack(false, false); er != nil {
+				w.log.Errorf("Consuming stopped: %v", er)
+				return
+			}
 
-				continue
+			continue
+		}
+
+		var task Task
+		if err := json.Unmarshal(d.Body, &task); err != nil {
+
+			if er := d.Nack(false, false); er != nil {
+				w.log.Errorf("Consuming stopped: %v", er)
+				return
 			}
 
-			var task Task
-			if err := json.Unmarshal(d.Body, &task); err != nil {
+			w.log.Errorf("%v, task body: %s", errors.New("Can't unmarshal received task"), string(d.Body))
+			continue
+		}
 
-				if er := d.Nack(false, false); er != nil {
-					w.log.Errorf("Consuming stopped: %v", er)
-					return
-				}
+		taskConfig, ok := w.tasks[task.Name]
+		if !ok {
 
-				w.log.Errorf("%v, task body: %s", errors.New("Can't unmarshal received task"), string(d.Body))
-				continue
+			if er := d.Nack(false, true); er != nil {
+				w.log.Errorf("Consuming stopped: %v", er)
+				return
 			}
 
-			taskConfig, ok := w.tasks[task.Name]
-			if !ok {
+			w.log.Errorf("Received task (%s-%s) which is not registered in this worker, task was requeued, but somebody should take it from this queue in other case error will be retried", task.Name, task.UUID)
+			continue
+		}
 
-				if er := d.Nack(false, true); er != nil {
-					w.log.Errorf("Consuming stopped: %v", er)
-					return
-				}
+		w.sem <- struct{}{}
+		w.tasksInProgress.Add(1)
+
+		go w.consumeOne(ctx, queue, d, task, taskConfig)
+
+	}
+
+}
+
+// nextDelivery picks the next delivery to process, in the order implied by
+// strictPriority, blocking until one is ready, w.stopConsume fires, or neither
+// queue had anything within a short poll window (in which case ok and stopped are
+// both false, so the caller just loops back round and tries again).
+func (w *Worker) nextDelivery(deliveries map[string]<-chan amqp.Delivery) (queue string, d amqp.Delivery, ok bool, stopped bool) {
+
+	if w.strictPriority {
+		return w.nextDeliveryStrict(deliveries)
+	}
+
+	return w.nextDeliveryWeighted(deliveries)
+
+}
 
-				w.log.Errorf("Received task (%s-%s) which is not registered in this worker, task was requeued, but somebody should take it from this queue in other case error will be retried", task.Name, task.UUID)
+const dispatchPollInterval = 20 * time.Millisecond
+
+// nextDeliveryStrict tries each queue in descending weight order with a short poll,
+// returning the first delivery found; a queue that yields nothing within the poll
+// window is skipped in favor of the next (lower-priority) one this round.
+func (w *Worker) nextDeliveryStrict(deliveries map[string]<-chan amqp.Delivery) (string, amqp.Delivery, bool, bool) {
+
+	for _, queue := range w.priorityOrder() {
+
+		select {
+		case <-w.stopConsume:
+			return "", amqp.Delivery{}, false, true
+		case d, ok := <-deliveries[queue]:
+			if !ok {
 				continue
 			}
+			return queue, d, true, false
+		case <-time.After(dispatchPollInterval):
+		}
+
+	}
+
+	return "", amqp.Delivery{}, false, false
+
+}
+
+// priorityOrder returns this worker's queues sorted by weight, highest first.
+func (w *Worker) priorityOrder() []string {
+
+	order := make([]string, 0, len(w.queues))
+	for queue := range w.queues {
+		order = append(order, queue)
+	}
+
+	sort.Slice(order, func(i, j int) bool {
+		return w.queues[order[i]] > w.queues[order[j]]
+	})
+
+	return order
+
+}
+
+// nextDeliveryWeighted waits on every queue at once via a dynamically built select,
+// with each queue's channel entered once per unit of weight - so when several queues
+// are ready simultaneously, reflect.Select's uniform-random tie-break among ready
+// cases ends up picking a queue with probability proportional to its weight.
+func (w *Worker) nextDeliveryWeighted(deliveries map[string]<-chan amqp.Delivery) (string, amqp.Delivery, bool, bool) {
 
-			w.tasksInProgress.Add(1)
+	order := w.weightedOrder()
 
-			go w.consumeOne(d, task, taskConfig)
+	cases := make([]reflect.SelectCase, 0, len(order)+2)
+	queueForCase := make([]string, 0, len(order)+2)
 
+	for _, queue := range order {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(deliveries[queue])})
+		queueForCase = append(queueForCase, queue)
+	}
+
+	stopIndex := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.stopConsume)})
+
+	timeoutIndex := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(dispatchPollInterval))})
+
+	chosen, value, ok := reflect.Select(cases)
+
+	switch {
+	case chosen == stopIndex:
+		return "", amqp.Delivery{}, false, true
+	case chosen == timeoutIndex || !ok:
+		return "", amqp.Delivery{}, false, false
+	default:
+		return queueForCase[chosen], value.Interface().(amqp.Delivery), true, false
+	}
+
+}
+
+// weightedOrder expands every queue into one entry per unit of weight and shuffles
+// the result, so nextDeliveryWeighted's reflect.Select has more chances to land on
+// a heavier queue without ever fully starving a lighter one.
+func (w *Worker) weightedOrder() []string {
+
+	expanded := make([]string, 0, len(w.queues))
+
+	for queue, weight := range w.queues {
+		if weight <= 0 {
+			weight = 1
+		}
+		for i := 0; i < weight; i++ {
+			expanded = append(expanded, queue)
 		}
 	}
 
+	rand.Shuffle(len(expanded), func(i, j int) {
+		expanded[i], expanded[j] = expanded[j], expanded[i]
+	})
+
+	return expanded
+
 }
 
-// Close function gracefully closes worker.
-// At first this function stops worker consuming, then waits until all started by this worker tasks will be finished
-// after all of this it closes channel.
-// This function is also used by server close function for graceful quit of all workers.
+// Close function gracefully closes worker, waiting as long as it takes for in-flight
+// tasks to finish. It is equivalent to Shutdown(context.Background()) and is kept for
+// callers that don't need a bounded shutdown; prefer Shutdown when you want forced
+// cancellation after a deadline.
 func (w *Worker) Close() {
+	w.Shutdown(context.Background())
+}
+
+// Shutdown gracefully stops the worker: it stops consuming new deliveries, then waits
+// for in-flight tasks to finish until ctx is done. If ctx is done first, Shutdown
+// cancels every in-flight task's context (only tasks registered with ContextAsFirstArg
+// can act on this) and gives them a further second to return. Tasks that still haven't
+// returned after that grace period have their delivery Nacked with requeue, so another
+// worker can pick them up, and Shutdown returns without waiting for them any longer.
+func (w *Worker) Shutdown(ctx context.Context) error {
+
+	w.log.Debugf("Worker %s shutdown started", w.name)
 
-	w.log.Debugf("Worker %s closing started", w.name)
+	// Shared with resubscribe: both read-then-flip w.working and send-then-close
+	// w.stopConsume/w.consumingStopped, and a reconnect racing an ordinary graceful
+	// shutdown is nothing exotic - without this lock both can see w.working true and
+	// both try to close the same channels, which panics.
+	w.resubscribeMu.Lock()
+	defer w.resubscribeMu.Unlock()
 
 	if !w.working {
-		return
+		return nil
 	}
 
 	w.working = false
@@ -260,21 +588,86 @@ func (w *Worker) Close() {
 	<-w.consumingStopped
 	close(w.consumingStopped)
 
-	w.tasksInProgress.Wait()
+	finished := make(chan struct{})
+	go func() {
+		w.tasksInProgress.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+
+	case <-ctx.Done():
+
+		w.log.Errorf("Worker %s: shutdown deadline reached with tasks still in flight, cancelling them", w.name)
+		w.cancelInFlight()
+
+		grace := time.NewTimer(time.Second)
+		defer grace.Stop()
+
+		select {
+		case <-finished:
+		case <-grace.C:
+			w.log.Errorf("Worker %s: tasks did not stop within grace period, requeuing what's left", w.name)
+			w.requeueInFlight()
+		}
+
+	}
 
-	w.ch.Close()
+	if w.transport != nil {
+		w.transport.Close()
+	} else {
+		w.ch.Close()
+		for _, ch := range w.consumeChannels {
+			ch.Close()
+		}
+	}
 
 	w.log.Infof("Worker %s is closed", w.name)
 
+	return nil
+
+}
+
+// cancelInFlight cancels the per-task context of every task still running, so tasks
+// registered with ContextAsFirstArg get a chance to notice and return early.
+func (w *Worker) cancelInFlight() {
+	w.inFlight.Range(func(_, v interface{}) bool {
+		t := v.(*inFlightTask)
+		atomic.StoreInt32(&t.forceCancelled, 1)
+		t.cancel()
+		return true
+	})
 }
 
-func (w *Worker) consumeOne(d amqp.Delivery, task Task, taskConfig TaskConfig) {
+// requeueInFlight Nacks-with-requeue the delivery of every task still running once the
+// forced-cancellation grace period has elapsed, guarded so a task that finishes on its
+// own at the same moment doesn't also try to Ack/Nack the same delivery.
+func (w *Worker) requeueInFlight() {
+	w.inFlight.Range(func(k, v interface{}) bool {
+		t := v.(*inFlightTask)
+		if t.finalize() {
+			t.requeue()
+		}
+		w.inFlight.Delete(k)
+		return true
+	})
+}
+
+func (w *Worker) consumeOne(ctx context.Context, queue string, d amqp.Delivery, task Task, taskConfig TaskConfig) {
 	defer w.tasksInProgress.Done()
+	defer func() { <-w.sem }()
 
 	var err error
 
 	w.log.Infof("Handling task %s", task.UUID)
 
+	w.metrics.TaskReceived(w.name, queue)
+	w.metrics.InFlightDelta(w.name, queue, 1)
+	defer w.metrics.InFlightDelta(w.name, queue, -1)
+
+	startedAt := time.Now()
+
 	reflectedTaskFunction := reflect.ValueOf(taskConfig.Function)
 
 	if taskConfig.TaskUUIDAsFirstArg {
@@ -292,17 +685,102 @@ func (w *Worker) consumeOne(d amqp.Delivery, task Task, taskConfig TaskConfig) {
 		return
 	}
 
-	timeouted := tryCall(reflectedTaskFunction, reflectedTaskArgs, taskConfig.TimeoutSeconds)
-	if timeouted {
-		w.log.Infof("Task %s exceeded timeout, taking next task", task.UUID)
+	var taskCtx context.Context
+	var cancel context.CancelFunc
+
+	if taskConfig.TimeoutSeconds > 0 {
+		taskCtx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(taskConfig.TimeoutSeconds))
 	} else {
+		taskCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	inFlight := &inFlightTask{cancel: cancel, requeue: func() { d.Nack(false, true) }}
+	w.inFlight.Store(task.UUID, inFlight)
+	defer w.inFlight.Delete(task.UUID)
+
+	if taskConfig.ContextAsFirstArg {
+		reflectedTaskArgs = append([]reflect.Value{reflect.ValueOf(taskCtx)}, reflectedTaskArgs...)
+	}
+
+	attempt := broker.RetryCountFromHeaders(d.Headers)
+
+	timeouted, callErr, stack := tryCall(taskCtx, reflectedTaskFunction, reflectedTaskArgs)
+
+	if !inFlight.finalize() {
+		// Worker.Shutdown already requeued this delivery after the task blew through
+		// its forced-cancellation grace period; nothing left for us to do.
+		return
+	}
+
+	if inFlight.wasForceCancelled() {
+		// Shutdown force-cancelled taskCtx to get tryCall to return; that tells us
+		// nothing about whether the task function itself ever actually finished, so
+		// it must not be treated as a success. Requeue it exactly like the slower
+		// grace-period path in requeueInFlight does.
+		w.log.Errorf("Task %s abandoned by forced shutdown, requeuing", task.UUID)
+		d.Nack(false, true)
+		return
+	}
+
+	duration := time.Since(startedAt)
+
+	switch {
+	case timeouted:
+		w.log.Infof("Task %s exceeded timeout, taking next task", task.UUID)
+		w.metrics.TaskTimedOut(w.name, queue, duration)
+		w.retryOrDeadLetter(d, queue, task, taskConfig, attempt, errors.New("task execution timed out"), nil)
+	case stack != nil:
+		w.log.Errorf("Task %s panicked: %v", task.UUID, callErr)
+		w.metrics.TaskPanicked(w.name, queue, duration)
+		w.retryOrDeadLetter(d, queue, task, taskConfig, attempt, callErr, stack)
+	case callErr != nil:
+		w.log.Errorf("Task %s failed: %v", task.UUID, callErr)
+		w.metrics.TaskFailed(w.name, queue, duration)
+		w.retryOrDeadLetter(d, queue, task, taskConfig, attempt, callErr, stack)
+	default:
 		w.log.Infof("Task %s was finished", task.UUID)
+		w.metrics.TaskSucceeded(w.name, queue, duration)
+		d.Ack(false)
+		w.notifyTaskComplete(TaskResult{TaskName: task.Name, TaskUUID: task.UUID, Worker: w.name, Attempt: attempt})
+	}
+
+}
+
+// retryOrDeadLetter is called once a task has failed (error or panic) or timed out.
+// It republishes the task to the delay queue for another attempt, unless
+// TaskConfig.MaxRetries has already been reached, in which case the task is sent
+// to the worker's dead letter destination instead. Either way the original
+// delivery is Acked, since the retry/dead-lettered copy is now the system of record.
+func (w *Worker) retryOrDeadLetter(d amqp.Delivery, queue string, task Task, taskConfig TaskConfig, attempt int, taskErr error, stack []byte) {
+
+	if attempt < taskConfig.MaxRetries {
+
+		nextAttempt := attempt + 1
+
+		if err := w.scheduleRetry(d, queue, taskConfig, nextAttempt, taskErr); err != nil {
+			w.log.Errorf("Can't schedule retry for task %s, dead-lettering instead: %v", task.UUID, err)
+		} else {
+			w.metrics.TaskRetried(w.name, queue)
+			d.Ack(false)
+			w.notifyTaskComplete(TaskResult{TaskName: task.Name, TaskUUID: task.UUID, Worker: w.name, Attempt: nextAttempt, Err: taskErr, Stack: stack})
+			return
+		}
+
 	}
 
+	w.sendToDeadLetter(d, task, attempt, taskErr, stack)
 	d.Ack(false)
+	w.notifyTaskComplete(TaskResult{TaskName: task.Name, TaskUUID: task.UUID, Worker: w.name, Attempt: attempt, Err: taskErr, Stack: stack, DeadLettered: true})
 
 }
 
+func (w *Worker) notifyTaskComplete(result TaskResult) {
+	if w.onTaskComplete != nil {
+		w.onTaskComplete(result)
+	}
+}
+
 func reflectArgs(args []TaskArgument) ([]reflect.Value, error) {
 	argValues := make([]reflect.Value, len(args))
 
@@ -317,32 +795,69 @@ func reflectArgs(args []TaskArgument) ([]reflect.Value, error) {
 	return argValues, nil
 }
 
-func tryCall(f reflect.Value, args []reflect.Value, timeoutSeconds int64) (finishedByTimeout bool) {
-
-	defer func() {
-		if e := recover(); e != nil {
-			fmt.Printf("%s", debug.Stack())
-		}
-	}()
+// errorInterface is used to detect whether the last return value of a task
+// function is an error, so that a non-nil error result can drive retries
+// the same way a panic does.
+var errorInterface = reflect.TypeOf((*error)(nil)).Elem()
+
+// callResult is what f.Call's goroutine sends back to tryCall: either the
+// function's normal return values, or - if f panicked - the recovered error
+// and stack. Exactly one of the two is ever set.
+type callResult struct {
+	values     []reflect.Value
+	panicErr   error
+	panicStack []byte
+}
 
-	if timeoutSeconds == 0 {
-		f.Call(args)
-		return false
-	}
+// tryCall invokes f and waits for either it to return or ctx to be done, whichever
+// comes first. It does not (and, built on reflect.Value.Call, cannot) kill the
+// goroutine running f once ctx is done - instead, cancellation is expected to
+// propagate through ctx itself, which is why TaskConfig.ContextAsFirstArg exists:
+// tasks that accept the context can observe ctx.Done() and return promptly.
+//
+// f runs in its own goroutine so a timed-out call can be abandoned without
+// blocking tryCall on it; recover must live in that same goroutine; a defer in
+// tryCall itself would be on the wrong goroutine's stack and would never see
+// a panic from f.Call at all.
+func tryCall(ctx context.Context, f reflect.Value, args []reflect.Value) (timeouted bool, callErr error, panicStack []byte) {
 
-	timer := time.NewTimer(time.Second * time.Duration(timeoutSeconds))
-	resultsChan := make(chan []reflect.Value)
+	resultsChan := make(chan callResult, 1)
 
 	go func() {
-		resultsChan <- f.Call(args)
+
+		defer func() {
+			if e := recover(); e != nil {
+				resultsChan <- callResult{panicErr: fmt.Errorf("task panicked: %v", e), panicStack: debug.Stack()}
+			}
+		}()
+
+		resultsChan <- callResult{values: f.Call(args)}
+
 	}()
 
 	select {
-	case <-timer.C:
-		return true
-	case <-resultsChan:
+	case <-ctx.Done():
+		return errors.Is(ctx.Err(), context.DeadlineExceeded), nil, nil
+	case result := <-resultsChan:
+		if result.panicErr != nil {
+			return false, result.panicErr, result.panicStack
+		}
+		return false, lastResultAsError(result.values), nil
+	}
+}
+
+// lastResultAsError inspects the last value returned by a task function and,
+// if it implements error and is non-nil, returns it.
+func lastResultAsError(results []reflect.Value) error {
+
+	if len(results) == 0 {
+		return nil
+	}
 
+	last := results[len(results)-1]
+	if !last.Type().Implements(errorInterface) || last.IsNil() {
+		return nil
 	}
 
-	return false
+	return last.Interface().(error)
 }
@@ -0,0 +1,53 @@
+package dispatcher
+
+import "testing"
+
+func TestPriorityOrder(t *testing.T) {
+
+	w := &Worker{queues: map[string]int{"low": 1, "high": 10, "mid": 5}}
+
+	got := w.priorityOrder()
+	want := []string{"high", "mid", "low"}
+
+	if len(got) != len(want) {
+		t.Fatalf("priorityOrder() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("priorityOrder() = %v, want %v", got, want)
+			break
+		}
+	}
+
+}
+
+func TestWeightedOrderExpandsByWeight(t *testing.T) {
+
+	w := &Worker{queues: map[string]int{"a": 2, "b": 3}}
+
+	order := w.weightedOrder()
+	if len(order) != 5 {
+		t.Fatalf("weightedOrder() has %d entries, want 5", len(order))
+	}
+
+	counts := map[string]int{}
+	for _, q := range order {
+		counts[q]++
+	}
+
+	if counts["a"] != 2 || counts["b"] != 3 {
+		t.Errorf("weightedOrder() counts = %v, want a:2 b:3", counts)
+	}
+
+}
+
+func TestWeightedOrderTreatsNonPositiveWeightAsOne(t *testing.T) {
+
+	w := &Worker{queues: map[string]int{"a": 0, "b": -5}}
+
+	order := w.weightedOrder()
+	if len(order) != 2 {
+		t.Fatalf("weightedOrder() has %d entries, want 2", len(order))
+	}
+
+}